@@ -4,68 +4,278 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 	"time"
 
-	"github.com/Sirupsen/logrus"
 	engineapi "github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/events"
 	"github.com/docker/swarm-v2/api"
 	"github.com/docker/swarm-v2/log"
 	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 )
 
+// pullProgressRate bounds how often pullImage invokes its progress
+// callback. The engine can emit dozens of progress lines per second for a
+// single layer; the dispatcher only needs enough signal to move task
+// status along, not a blow-by-blow transcript.
+const pullProgressRate = time.Second
+
+// pullProgress is a reduced view of a single line of the image pull JSON
+// stream, keeping only what's useful for surfacing as task status.
+type pullProgress struct {
+	ID      string
+	Status  string
+	Current int64
+	Total   int64
+}
+
+// PullProgressFunc receives throttled progress updates for an in-flight
+// image pull. It is called synchronously from pullImage's stream decode
+// loop, so it must not block for long.
+type PullProgressFunc func(pullProgress)
+
+// pullMessage mirrors the subset of the engine's image pull JSON stream
+// that pullImage cares about.
+type pullMessage struct {
+	Status string `json:"status"`
+	ID     string `json:"id"`
+	Error  string `json:"error"`
+
+	ErrorDetail *pullErrorDetail `json:"errorDetail"`
+
+	ProgressDetail *struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+// pullErrorDetail is the engine's errorDetail object for a failed pull.
+type pullErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// pullError preserves the engine's errorDetail for a failed pull. It is
+// always returned wrapped in a classified *adapterError (see
+// classifyPullError), never bare, so that registry-auth and not-found
+// pull failures - which arrive through the stream, not ImagePull's own
+// return value - are just as classifiable as any other adapter error.
+type pullError struct {
+	Code    int
+	Message string
+}
+
+func (e *pullError) Error() string {
+	return e.Message
+}
+
+// classifyPullError classifies a failure surfaced via the pull stream's
+// errorDetail. This is where registry auth and not-found failures
+// actually show up in practice: the initial ImagePull call error only
+// covers failures before the stream starts (bad reference syntax, engine
+// unreachable, ...), not the 401/404 the registry returns mid-stream.
+// The engine's HTTP-style code takes priority; classifyErrorString is the
+// fallback for engines/registries that don't set one.
+func classifyPullError(detail *pullErrorDetail, msg string) error {
+	cause := &pullError{Message: msg}
+	if detail != nil {
+		cause.Code = detail.Code
+		cause.Message = detail.Message
+	}
+
+	var class error
+	switch cause.Code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		class = errRegistryAuth
+	case http.StatusNotFound:
+		class = errImageNotFound
+	default:
+		class = classifyErrorString(cause.Message)
+	}
+
+	return &adapterError{cause: cause, class: class}
+}
+
+// RegistryAuthFn resolves the base64-encoded X-Registry-Auth value the
+// engine expects for a pull, sourced from the task's registry credentials.
+// It may be nil, in which case pulls are attempted unauthenticated.
+type RegistryAuthFn func(ctx context.Context) (string, error)
+
+// Defaults for the shared engine call rate limiter. A leader election
+// storm or a service rolling update can churn through many tasks at once;
+// without a cap, the resulting burst of create/start/remove calls can
+// overwhelm the local engine API and trigger cascading timeouts.
+const (
+	defaultEngineOpsPerSecond = 25
+	defaultEngineOpsBurst     = 50
+)
+
+// newDefaultEngineLimiter returns the rate limiter used when the executor
+// doesn't supply a shared one.
+func newDefaultEngineLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(defaultEngineOpsPerSecond), defaultEngineOpsBurst)
+}
+
 // containerController conducts remote operations for a container. All calls
 // are mostly naked calls to the client API, seeded with information from
 // containerConfig.
 type containerAdapter struct {
-	client    engineapi.APIClient
-	container *containerConfig
+	client       engineapi.APIClient
+	container    *containerConfig
+	registryAuth RegistryAuthFn
+
+	// dispatcher is the process-wide event stream, owned by the executor
+	// and shared across every adapter on the node.
+	dispatcher *eventDispatcher
+
+	// limiter gates mutating engine calls. It is shared across every
+	// adapter on the node so that one service's restart loop can't starve
+	// the rest of the engine API's budget.
+	limiter *rate.Limiter
+
+	// pulledImageDigest is the canonical content digest resolved after a
+	// successful pull. Pinning replicas to it rather than a mutable tag is
+	// the controller's job - it should read pulledDigest() after a
+	// successful pullImage and write it into the task's ContainerStatus.
+	// There's no controller in this tree to wire that into, so as it
+	// stands this value is resolved but goes nowhere; the replica-pinning
+	// outcome isn't delivered until that wiring exists.
+	pulledImageDigest string
 }
 
-func newContainerAdapter(client engineapi.APIClient, task *api.Task) (*containerAdapter, error) {
+func newContainerAdapter(client engineapi.APIClient, task *api.Task, registryAuth RegistryAuthFn, dispatcher *eventDispatcher, limiter *rate.Limiter) (*containerAdapter, error) {
 	ctnr, err := newContainerConfig(task)
 	if err != nil {
 		return nil, err
 	}
 
+	if limiter == nil {
+		limiter = newDefaultEngineLimiter()
+	}
+
 	return &containerAdapter{
-		client:    client,
-		container: ctnr,
+		client:       client,
+		container:    ctnr,
+		registryAuth: registryAuth,
+		dispatcher:   dispatcher,
+		limiter:      limiter,
 	}, nil
 }
 
+// pulledDigest returns the canonical digest resolved by the most recent
+// call to pullImage, or "" if none has been resolved yet.
+func (c *containerAdapter) pulledDigest() string {
+	return c.pulledImageDigest
+}
+
 func noopPrivilegeFn() (string, error) { return "", nil }
 
-func (c *containerAdapter) pullImage(ctx context.Context) error {
-	rc, err := c.client.ImagePull(ctx, c.container.image(),
-		types.ImagePullOptions{
-			PrivilegeFunc: noopPrivilegeFn,
-		})
-	if err != nil {
+// pullImage pulls the configured image, reporting throttled progress to
+// reportProgress, which may be nil.
+func (c *containerAdapter) pullImage(ctx context.Context, reportProgress PullProgressFunc) error {
+	opts := types.ImagePullOptions{
+		PrivilegeFunc: noopPrivilegeFn,
+	}
+
+	if c.registryAuth != nil {
+		auth, err := c.registryAuth(ctx)
+		if err != nil {
+			return &adapterError{cause: err, class: errRegistryAuth}
+		}
+		opts.RegistryAuth = auth
+	}
+
+	if err := c.limiter.Wait(ctx); err != nil {
 		return err
 	}
 
+	rc, err := c.client.ImagePull(ctx, c.container.image(), opts)
+	if err != nil {
+		return classifyError(err)
+	}
+	defer rc.Close()
+
+	progressLimiter := rate.NewLimiter(rate.Every(pullProgressRate), 1)
+
 	dec := json.NewDecoder(rc)
-	m := map[string]interface{}{}
+	var last pullMessage
 	for {
-		if err := dec.Decode(&m); err != nil {
+		// json.Decode doesn't zero its target, so a value reused across
+		// iterations would leak a prior line's pointer fields (and Error)
+		// into lines that don't set them. Decode fresh each time.
+		var msg pullMessage
+		if err := dec.Decode(&msg); err != nil {
 			if err == io.EOF {
 				break
 			}
 			return err
 		}
-		// TOOD(stevvooe): Report this status somewhere.
-		logrus.Debugln("pull progress", m)
+		last = msg
+
+		if reportProgress != nil && progressLimiter.Allow() {
+			p := pullProgress{ID: msg.ID, Status: msg.Status}
+			if msg.ProgressDetail != nil {
+				p.Current = msg.ProgressDetail.Current
+				p.Total = msg.ProgressDetail.Total
+			}
+			reportProgress(p)
+		}
+	}
+
+	// if the final stream object contained an error, classify and return it.
+	if last.Error != "" {
+		return classifyPullError(last.ErrorDetail, last.Error)
+	}
+
+	inspect, _, err := c.client.ImageInspectWithRaw(ctx, c.container.image())
+	if err != nil {
+		// the pull succeeded; failing to resolve the digest afterwards
+		// shouldn't fail the task, it just means we keep running off the tag.
+		log.G(ctx).Errorf("failed to resolve digest for %s: %v", c.container.image(), err)
+		return nil
 	}
-	// if the final stream object contained an error, return it
-	if errMsg, ok := m["error"]; ok {
-		return fmt.Errorf("%v", errMsg)
+
+	if digest := repoDigestForImage(c.container.image(), inspect.RepoDigests); digest != "" {
+		c.pulledImageDigest = digest
+	} else if len(inspect.RepoDigests) > 0 {
+		// A multi-repo image (the same content pushed under more than one
+		// name) can list RepoDigests for repos other than the one we
+		// pulled. Pinning the wrong one would be worse than not pinning,
+		// so leave pulledImageDigest unset rather than guess.
+		log.G(ctx).Warnf("no RepoDigest matched %s among %v, not pinning", c.container.image(), inspect.RepoDigests)
 	}
+
 	return nil
 }
 
+// repoDigestForImage returns the entry in repoDigests (each formatted
+// "<repo>@<digest>") whose repo matches image's repo, or "" if none does.
+func repoDigestForImage(image string, repoDigests []string) string {
+	repo := imageRepo(image)
+	for _, rd := range repoDigests {
+		if imageRepo(rd) == repo {
+			return rd
+		}
+	}
+	return ""
+}
+
+// imageRepo strips the tag or digest suffix from a reference, leaving just
+// the repo name, e.g. "docker.io/library/redis:6@sha256:..." becomes
+// "docker.io/library/redis".
+func imageRepo(ref string) string {
+	if at := strings.Index(ref, "@"); at != -1 {
+		ref = ref[:at]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
 func (c *containerAdapter) createNetworks(ctx context.Context) error {
 	for _, network := range c.container.networks() {
 		opts, err := c.container.networkCreateOptions(network)
@@ -73,12 +283,17 @@ func (c *containerAdapter) createNetworks(ctx context.Context) error {
 			return err
 		}
 
+		if err := c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
 		if _, err := c.client.NetworkCreate(ctx, network, opts); err != nil {
-			if isNetworkExistError(err, network) {
+			cerr := classifyError(err)
+			if isClass(cerr, errNetworkExists) {
 				continue
 			}
 
-			return err
+			return cerr
 		}
 	}
 
@@ -87,111 +302,133 @@ func (c *containerAdapter) createNetworks(ctx context.Context) error {
 
 func (c *containerAdapter) removeNetworks(ctx context.Context) error {
 	for _, nid := range c.container.networks() {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
 		if err := c.client.NetworkRemove(ctx, nid); err != nil {
-			if isActiveEndpointError(err) {
+			cerr := classifyError(err)
+			if isClass(cerr, errNetworkBusy) {
 				continue
 			}
 
 			log.G(ctx).Errorf("network %s remove failed", nid)
-			return err
+			return cerr
 		}
 	}
 
 	return nil
 }
 
-func isActiveEndpointError(err error) bool {
-	// TODO(mrjana): There is no proper error code for network not
-	// found error in engine-api. Resort to string matching until
-	// engine-api is fixed.
-	return strings.Contains(err.Error(), "has active endpoints")
-}
-
-func isNetworkExistError(err error, name string) bool {
-	// TODO(mrjana): There is no proper error code for network not
-	// found error in engine-api. Resort to string matching until
-	// engine-api is fixed.
-	return strings.Contains(err.Error(), fmt.Sprintf("network with name %s already exists", name))
-}
-
 func (c *containerAdapter) create(ctx context.Context) error {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
 	if _, err := c.client.ContainerCreate(ctx,
 		c.container.config(),
 		c.container.hostConfig(),
 		c.container.networkingConfig(),
 		c.container.name()); err != nil {
-		return err
+		return classifyError(err)
 	}
 
 	return nil
 }
 
 func (c *containerAdapter) start(ctx context.Context) error {
-	return c.client.ContainerStart(ctx, c.container.name())
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	if err := c.client.ContainerStart(ctx, c.container.name()); err != nil {
+		return classifyError(err)
+	}
+
+	return nil
 }
 
 func (c *containerAdapter) inspect(ctx context.Context) (types.ContainerJSON, error) {
-	return c.client.ContainerInspect(ctx, c.container.name())
+	info, err := c.client.ContainerInspect(ctx, c.container.name())
+	if err != nil {
+		return info, classifyError(err)
+	}
+
+	return info, nil
 }
 
-// events issues a call to the events API and returns a channel with all
-// events. The stream of events can be shutdown by cancelling the context.
-//
-// A chan struct{} is returned that will be closed if the event procressing
-// fails and needs to be restarted.
-func (c *containerAdapter) events(ctx context.Context) (<-chan events.Message, <-chan struct{}, error) {
-	// TODO(stevvooe): Move this to a single, global event dispatch. For
-	// now, we create a connection per container.
-	var (
-		eventsq = make(chan events.Message)
-		closed  = make(chan struct{})
-	)
+// errUnhealthy is returned by waitHealthy when the engine reports the
+// container's health check as unhealthy.
+var errUnhealthy = fmt.Errorf("container is unhealthy")
 
-	log.G(ctx).Debugf("waiting on events")
-	// TODO(stevvooe): For long running tasks, it is likely that we will have
-	// to restart this under failure.
-	rc, err := c.client.Events(ctx, types.EventsOptions{
-		Since:   "0",
-		Filters: c.container.eventFilter(),
-	})
+// waitHealthy blocks until the container's health check (if any) reports
+// healthy. If the container has no healthcheck configured, it returns
+// immediately. It returns errUnhealthy if the container becomes unhealthy,
+// or ctx.Err() if ctx is cancelled first.
+//
+// This relies on Config.Healthcheck, State.Health and the types.Healthy /
+// types.Unhealthy constants, which engine-api only grew once the vendored
+// engine supports Docker 1.12-style health checks. This repo has no
+// vendor/ tree to check against at the time of writing - confirm the
+// pinned github.com/docker/engine-api revision actually exports these
+// before merging, and bump it if it predates health check support.
+func (c *containerAdapter) waitHealthy(ctx context.Context) error {
+	info, err := c.inspect(ctx)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	go func(rc io.ReadCloser) {
-		defer rc.Close()
-		defer close(closed)
+	if info.Config == nil || info.Config.Healthcheck == nil || len(info.Config.Healthcheck.Test) == 0 {
+		return nil
+	}
 
-		select {
-		case <-ctx.Done():
-			// exit
-			return
-		default:
-		}
+	// Subscribe before re-inspecting: if we inspected first, a transition
+	// to healthy landing between that inspect and the subscribe would be
+	// missed, and with no further health event waitHealthy would block
+	// until ctx cancellation.
+	eventsq, cancel := c.events(ctx)
+	defer cancel()
 
-		dec := json.NewDecoder(rc)
+	info, err = c.inspect(ctx)
+	if err != nil {
+		return err
+	}
 
-		for {
-			var event events.Message
-			if err := dec.Decode(&event); err != nil {
-				// TODO(stevvooe): This error handling isn't quite right.
-				if err == io.EOF {
-					return
-				}
+	if info.State != nil && info.State.Health != nil {
+		switch info.State.Health.Status {
+		case types.Healthy:
+			return nil
+		case types.Unhealthy:
+			return errUnhealthy
+		}
+	}
 
-				log.G(ctx).Errorf("error decoding event: %v", err)
-				return
+	for {
+		select {
+		case event := <-eventsq:
+			if !strings.HasPrefix(event.Action, "health_status:") {
+				continue
 			}
 
-			select {
-			case eventsq <- event:
-			case <-ctx.Done():
-				return
+			switch strings.TrimSpace(strings.TrimPrefix(event.Action, "health_status:")) {
+			case "healthy":
+				return nil
+			case "unhealthy":
+				return errUnhealthy
 			}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-	}(rc)
+	}
+}
 
-	return eventsq, closed, nil
+// events returns a channel of events for this adapter's container, sourced
+// from the shared, process-wide eventDispatcher rather than a dedicated
+// /events connection. The returned unsubscribe func must be called once
+// the caller is done, typically via defer.
+func (c *containerAdapter) events(ctx context.Context) (<-chan events.Message, func()) {
+	log.G(ctx).Debugf("waiting on events")
+	return c.dispatcher.Subscribe(c.container.name())
 }
 
 func (c *containerAdapter) shutdown(ctx context.Context) error {
@@ -200,21 +437,45 @@ func (c *containerAdapter) shutdown(ctx context.Context) error {
 		return err
 	}
 
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
 	// TODO(stevvooe): Sending Stop isn't quite right. The timeout is actually
 	// a grace period between SIGTERM and SIGKILL. We'll have to play with this
 	// a little but to figure how much we defer to the engine.
-	return c.client.ContainerStop(ctx, c.container.name(), timeout)
+	if err := c.client.ContainerStop(ctx, c.container.name(), timeout); err != nil {
+		return classifyError(err)
+	}
+
+	return nil
 }
 
 func (c *containerAdapter) terminate(ctx context.Context) error {
-	return c.client.ContainerKill(ctx, c.container.name(), "")
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	if err := c.client.ContainerKill(ctx, c.container.name(), ""); err != nil {
+		return classifyError(err)
+	}
+
+	return nil
 }
 
 func (c *containerAdapter) remove(ctx context.Context) error {
-	return c.client.ContainerRemove(ctx, c.container.name(), types.ContainerRemoveOptions{
+	if err := c.limiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	if err := c.client.ContainerRemove(ctx, c.container.name(), types.ContainerRemoveOptions{
 		RemoveVolumes: true,
 		Force:         true,
-	})
+	}); err != nil {
+		return classifyError(err)
+	}
+
+	return nil
 }
 
 // resolveTimeout calculates the timeout for second granularity timeout using
@@ -0,0 +1,116 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+
+	engineapi "github.com/docker/engine-api/client"
+)
+
+// Sentinel classes returned by classifyError. Adapter methods and their
+// callers compare against these with errors.Is-style helpers (isClass)
+// rather than matching engine error strings themselves.
+//
+// errNetworkExists and errNetworkBusy are kept distinct even though both
+// originate from network lifecycle calls: errNetworkExists ("network with
+// name X already exists") is benign on create, while errNetworkBusy ("has
+// active endpoints") means remove can't proceed yet. Collapsing them into
+// one class would be fine for today's continue-on-either call sites, but
+// would be wrong the moment a caller keys retry policy off the class.
+var (
+	errImageNotFound          = fmt.Errorf("image not found")
+	errNoSuchContainer        = fmt.Errorf("no such container")
+	errContainerAlreadyExists = fmt.Errorf("container already exists")
+	errNetworkExists          = fmt.Errorf("network already exists")
+	errNetworkBusy            = fmt.Errorf("network has active endpoints")
+	errRegistryAuth           = fmt.Errorf("registry authentication failed")
+)
+
+// adapterError wraps an error returned by the engine API together with its
+// classification, so that retry policy can be decided on the class instead
+// of re-parsing engine error strings at every call site.
+type adapterError struct {
+	cause error
+	class error // one of the sentinel errs above, or nil if unclassified
+}
+
+func (e *adapterError) Error() string {
+	return e.cause.Error()
+}
+
+// Cause returns the underlying engine error.
+func (e *adapterError) Cause() error {
+	return e.cause
+}
+
+// Terminal reports whether this error represents a failure that will not
+// resolve itself on retry, as opposed to a transient engine hiccup. Only
+// the registry-auth and missing-image classes are terminal; there is no
+// class for invalid configuration, so such failures are not reported as
+// terminal.
+func (e *adapterError) Terminal() bool {
+	switch e.class {
+	case errImageNotFound, errRegistryAuth:
+		return true
+	default:
+		return false
+	}
+}
+
+// isClass reports whether err was classified as class by classifyError.
+func isClass(err error, class error) bool {
+	ae, ok := err.(*adapterError)
+	return ok && ae.class == class
+}
+
+// classifyError inspects an error returned by the engine API and wraps it
+// as an adapterError with a best-effort classification. It first checks
+// the typed errors engine-api's client package exposes (backed by HTTP
+// status code, not string matching) and only falls back to matching the
+// error strings the engine is known to return where engine-api has no
+// typed error for the condition (container name conflicts, network
+// existence/busy).
+//
+// IsErrImageNotFound/IsErrContainerNotFound/IsErrUnauthorized are assumed
+// present on the vendored github.com/docker/engine-api/client. This repo
+// has no vendor/ tree to confirm that against at the time of writing -
+// verify the pinned revision exports them before merging.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var class error
+	switch {
+	case engineapi.IsErrImageNotFound(err):
+		class = errImageNotFound
+	case engineapi.IsErrContainerNotFound(err):
+		class = errNoSuchContainer
+	case engineapi.IsErrUnauthorized(err):
+		class = errRegistryAuth
+	default:
+		class = classifyErrorString(err.Error())
+	}
+
+	return &adapterError{cause: err, class: class}
+}
+
+// classifyErrorString is the string-matching fallback for conditions
+// engine-api doesn't surface as a typed error.
+func classifyErrorString(msg string) error {
+	switch {
+	case strings.Contains(msg, "No such image"):
+		return errImageNotFound
+	case strings.Contains(msg, "No such container"):
+		return errNoSuchContainer
+	case strings.Contains(msg, "Conflict") && strings.Contains(msg, "already in use"):
+		return errContainerAlreadyExists
+	case strings.Contains(msg, "has active endpoints"):
+		return errNetworkBusy
+	case strings.Contains(msg, "already exists"):
+		return errNetworkExists
+	case strings.Contains(msg, "unauthorized"), strings.Contains(msg, "authentication required"):
+		return errRegistryAuth
+	}
+	return nil
+}
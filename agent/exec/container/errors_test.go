@@ -0,0 +1,88 @@
+package container
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClassifyErrorString(t *testing.T) {
+	cases := []struct {
+		msg   string
+		class error
+	}{
+		{"Error: No such image: redis:latest", errImageNotFound},
+		{"Error: No such container: abc123", errNoSuchContainer},
+		{`Conflict. The container name "/web" is already in use`, errContainerAlreadyExists},
+		{"network foo has active endpoints", errNetworkBusy},
+		{"network with name foo already exists", errNetworkExists},
+		{"unauthorized: authentication required", errRegistryAuth},
+		{"connection reset by peer", nil},
+	}
+
+	for _, c := range cases {
+		if got := classifyErrorString(c.msg); got != c.class {
+			t.Errorf("classifyErrorString(%q) = %v, want %v", c.msg, got, c.class)
+		}
+	}
+}
+
+func TestAdapterErrorTerminal(t *testing.T) {
+	cases := []struct {
+		class    error
+		terminal bool
+	}{
+		{errImageNotFound, true},
+		{errRegistryAuth, true},
+		{errNetworkBusy, false},
+		{errNoSuchContainer, false},
+		{errContainerAlreadyExists, false},
+		{nil, false},
+	}
+
+	for _, c := range cases {
+		err := &adapterError{cause: fmt.Errorf("boom"), class: c.class}
+		if got := err.Terminal(); got != c.terminal {
+			t.Errorf("Terminal() for class %v = %v, want %v", c.class, got, c.terminal)
+		}
+	}
+}
+
+func TestIsClass(t *testing.T) {
+	err := &adapterError{cause: fmt.Errorf("boom"), class: errImageNotFound}
+
+	if !isClass(err, errImageNotFound) {
+		t.Error("expected isClass to match errImageNotFound")
+	}
+	if isClass(err, errNetworkBusy) {
+		t.Error("expected isClass not to match errNetworkBusy")
+	}
+	if isClass(fmt.Errorf("plain error"), errImageNotFound) {
+		t.Error("expected isClass to be false for a non-adapterError")
+	}
+}
+
+func TestClassifyPullError(t *testing.T) {
+	cases := []struct {
+		name   string
+		detail *pullErrorDetail
+		msg    string
+		class  error
+	}{
+		{"unauthorized code", &pullErrorDetail{Code: 401, Message: "pull access denied"}, "", errRegistryAuth},
+		{"forbidden code", &pullErrorDetail{Code: 403, Message: "forbidden"}, "", errRegistryAuth},
+		{"not found code", &pullErrorDetail{Code: 404, Message: "not found"}, "", errImageNotFound},
+		{"no detail, message fallback", nil, "Error: No such image: redis:latest", errImageNotFound},
+		{"unclassifiable", nil, "transient registry hiccup", nil},
+	}
+
+	for _, c := range cases {
+		err, ok := classifyPullError(c.detail, c.msg).(*adapterError)
+		if !ok {
+			t.Errorf("%s: classifyPullError did not return an *adapterError", c.name)
+			continue
+		}
+		if err.class != c.class {
+			t.Errorf("%s: class = %v, want %v", c.name, err.class, c.class)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package container
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	engineapi "github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/swarm-v2/log"
+	"golang.org/x/net/context"
+)
+
+// eventDispatcher maintains a single client.Events subscription against the
+// engine and fans decoded events out to per-container subscribers, in place
+// of the one-/events-connection-per-container approach, which doesn't scale
+// to nodes running hundreds of tasks. It is owned by the executor and
+// shared by every containerAdapter on the node.
+type eventDispatcher struct {
+	client engineapi.APIClient
+
+	mu          sync.Mutex
+	since       time.Time
+	subscribers map[string][]chan events.Message // keyed by container name
+	idToName    map[string]string                // container id -> name, resolved lazily
+}
+
+// newEventDispatcher creates a dispatcher. Call run to start it; until run
+// is called, Subscribe only registers interest and delivers nothing.
+func newEventDispatcher(client engineapi.APIClient) *eventDispatcher {
+	return &eventDispatcher{
+		client:      client,
+		subscribers: make(map[string][]chan events.Message),
+		idToName:    make(map[string]string),
+	}
+}
+
+// run drives the dispatcher's single engine event stream until ctx is
+// cancelled, reconnecting with backoff whenever the stream ends. Each
+// reconnect resumes from the timestamp of the last event seen so that no
+// events are dropped across reconnects.
+func (d *eventDispatcher) run(ctx context.Context) {
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		err := d.stream(ctx)
+		if err == nil {
+			// the stream ended cleanly (EOF) rather than erroring out, so
+			// don't let a backoff grown during some earlier rough patch
+			// delay this reconnect.
+			backoff = time.Second
+		} else if ctx.Err() == nil {
+			log.G(ctx).Errorf("event stream failed, reconnecting: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// stream opens one engine event connection and delivers events to
+// subscribers until it ends or ctx is cancelled.
+//
+// d.since has only second granularity (dispatch derives it from event.Time),
+// so a reconnect can re-deliver one or more events from the same second as
+// the last one seen. That's a duplicate, not a drop, and subscribers
+// (waitHealthy et al.) already tolerate seeing a status event more than
+// once, so it isn't deduplicated here.
+func (d *eventDispatcher) stream(ctx context.Context) error {
+	since := "0"
+	d.mu.Lock()
+	if !d.since.IsZero() {
+		since = d.since.Format(time.RFC3339Nano)
+	}
+	d.mu.Unlock()
+
+	rc, err := d.client.Events(ctx, types.EventsOptions{Since: since})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dec := json.NewDecoder(rc)
+	for {
+		var event events.Message
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		d.dispatch(ctx, event)
+	}
+}
+
+func (d *eventDispatcher) dispatch(ctx context.Context, event events.Message) {
+	d.mu.Lock()
+	d.since = time.Unix(event.Time, 0)
+
+	if event.Type == events.ContainerEventType && event.Actor.Attributes["name"] != "" {
+		d.idToName[event.Actor.ID] = event.Actor.Attributes["name"]
+	}
+
+	name := d.idToName[event.Actor.ID]
+	if name == "" {
+		name = event.Actor.ID
+	}
+
+	// copy under the lock; the slice itself may be mutated by a concurrent
+	// unsubscribe once we let go of it.
+	subs := append([]chan events.Message(nil), d.subscribers[name]...)
+
+	if event.Type == events.ContainerEventType && event.Action == "destroy" {
+		// the container is gone for good; stop tracking its id->name
+		// mapping so idToName doesn't grow without bound on a long-lived
+		// node with heavy task churn.
+		delete(d.idToName, event.Actor.ID)
+	}
+
+	d.mu.Unlock()
+
+	// Sends are non-blocking: a subscriber that isn't draining its channel
+	// (e.g. a controller.Wait goroutine that leaked its subscription) must
+	// not stall delivery to every other container on the node. Dropping an
+	// event for a stalled subscriber is preferable to the cross-container
+	// coupling a blocking send would reintroduce.
+	for _, ch := range subs {
+		select {
+		case ch <- event:
+		default:
+			log.G(ctx).Warnf("event subscriber for %q is not keeping up, dropping event", name)
+		}
+	}
+}
+
+// Subscribe registers interest in events for the named container, returning
+// a channel of matching events and an unsubscribe func that must be called
+// to release it.
+func (d *eventDispatcher) Subscribe(name string) (<-chan events.Message, func()) {
+	ch := make(chan events.Message, 16)
+
+	d.mu.Lock()
+	d.subscribers[name] = append(d.subscribers[name], ch)
+	d.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+
+			subs := d.subscribers[name]
+			for i, c := range subs {
+				if c == ch {
+					d.subscribers[name] = append(subs[:i], subs[i+1:]...)
+					break
+				}
+			}
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
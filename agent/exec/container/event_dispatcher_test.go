@@ -0,0 +1,129 @@
+package container
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/engine-api/types/events"
+	"golang.org/x/net/context"
+)
+
+func TestEventDispatcherFanOut(t *testing.T) {
+	d := newEventDispatcher(nil)
+
+	ch, unsubscribe := d.Subscribe("web.1")
+	defer unsubscribe()
+
+	evt := events.Message{
+		Type:   events.ContainerEventType,
+		Action: "start",
+		Actor:  events.Actor{ID: "abc", Attributes: map[string]string{"name": "web.1"}},
+		Time:   1,
+	}
+	d.dispatch(context.Background(), evt)
+
+	select {
+	case got := <-ch:
+		if got.Actor.ID != "abc" {
+			t.Errorf("got event for actor %q, want %q", got.Actor.ID, "abc")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestEventDispatcherIgnoresOtherContainers(t *testing.T) {
+	d := newEventDispatcher(nil)
+
+	ch, unsubscribe := d.Subscribe("web.1")
+	defer unsubscribe()
+
+	d.dispatch(context.Background(), events.Message{
+		Type:   events.ContainerEventType,
+		Action: "start",
+		Actor:  events.Actor{ID: "xyz", Attributes: map[string]string{"name": "web.2"}},
+	})
+
+	select {
+	case got := <-ch:
+		t.Fatalf("unexpected event delivered for web.1: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventDispatcherDropsOnFullSubscriber(t *testing.T) {
+	d := newEventDispatcher(nil)
+
+	ch, unsubscribe := d.Subscribe("web.1")
+	defer unsubscribe()
+
+	evt := events.Message{
+		Type:   events.ContainerEventType,
+		Action: "start",
+		Actor:  events.Actor{ID: "abc", Attributes: map[string]string{"name": "web.1"}},
+	}
+
+	// Fill the subscriber's buffer and then dispatch one more: with
+	// nothing draining ch, that extra send must not block the dispatcher.
+	for i := 0; i < cap(ch)+1; i++ {
+		done := make(chan struct{})
+		go func() {
+			d.dispatch(context.Background(), evt)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("dispatch blocked on a full subscriber at iteration %d", i)
+		}
+	}
+}
+
+func TestEventDispatcherEvictsIDOnDestroy(t *testing.T) {
+	d := newEventDispatcher(nil)
+
+	d.dispatch(context.Background(), events.Message{
+		Type:   events.ContainerEventType,
+		Action: "start",
+		Actor:  events.Actor{ID: "abc", Attributes: map[string]string{"name": "web.1"}},
+	})
+
+	d.mu.Lock()
+	_, ok := d.idToName["abc"]
+	d.mu.Unlock()
+	if !ok {
+		t.Fatal("expected idToName to contain the container id after a start event")
+	}
+
+	d.dispatch(context.Background(), events.Message{
+		Type:   events.ContainerEventType,
+		Action: "destroy",
+		Actor:  events.Actor{ID: "abc"},
+	})
+
+	d.mu.Lock()
+	_, ok = d.idToName["abc"]
+	d.mu.Unlock()
+	if ok {
+		t.Fatal("expected idToName entry to be evicted after a destroy event")
+	}
+}
+
+func TestEventDispatcherUnsubscribe(t *testing.T) {
+	d := newEventDispatcher(nil)
+
+	ch, unsubscribe := d.Subscribe("web.1")
+	unsubscribe()
+
+	if _, ok := <-ch; ok {
+		t.Fatal("expected channel to be closed after unsubscribe")
+	}
+
+	d.mu.Lock()
+	subs := d.subscribers["web.1"]
+	d.mu.Unlock()
+	if len(subs) != 0 {
+		t.Fatalf("expected no subscribers left for web.1, got %d", len(subs))
+	}
+}
@@ -0,0 +1,42 @@
+package container
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+)
+
+func TestNewDefaultEngineLimiterDefaults(t *testing.T) {
+	l := newDefaultEngineLimiter()
+
+	if got, want := l.Limit(), rate.Limit(defaultEngineOpsPerSecond); got != want {
+		t.Errorf("limit = %v, want %v", got, want)
+	}
+	if got, want := l.Burst(), defaultEngineOpsBurst; got != want {
+		t.Errorf("burst = %v, want %v", got, want)
+	}
+}
+
+// TestEngineLimiterGatesBeyondBurst exercises the same limiter.Wait(ctx)
+// gating that create/start/remove/etc rely on: once burst tokens are
+// spent, Wait blocks until either more tokens accrue or ctx says to give
+// up - it doesn't silently let the call through.
+func TestEngineLimiterGatesBeyondBurst(t *testing.T) {
+	l := rate.NewLimiter(rate.Limit(1), 1)
+	ctx := context.Background()
+
+	if err := l.Wait(ctx); err != nil {
+		t.Fatalf("first Wait: unexpected error: %v", err)
+	}
+
+	// the single burst token is spent; a short-deadline ctx must time out
+	// rather than let a second call through immediately.
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	if err := l.Wait(waitCtx); err == nil {
+		t.Fatal("expected Wait to return an error once the burst is exhausted and ctx expires")
+	}
+}